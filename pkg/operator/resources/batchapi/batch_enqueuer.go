@@ -18,6 +18,7 @@ package batchapi
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -33,13 +34,29 @@ const (
 type SQSBatchUploader struct {
 	Client               *awslib.Client
 	QueueURL             string
-	Retries              *int // default 3 times
+	APIName              string          // used to key CircuitBreaker limits; required when CircuitBreaker is set
+	CircuitBreaker       *CircuitBreaker // optional; when nil, in-flight calls are unbounded
+	Retries              *int            // default 3 times
+	JobID                string          // used by NextBatchID to derive deterministic dedup ids; required when BatchIndexCounter is set
+	BatchIndexCounter    *int64          // optional shared counter (across all uploaders of one job) for deterministic dedup ids; nil falls back to randomID()
 	messageList          []*sqs.SendMessageBatchRequestEntry
 	messageIDToListIndex map[string]int
 	totalBytes           int
 	TotalBatches         int
 }
 
+// NextBatchID returns the id used for both the SQS message and its deduplication id. When
+// JobID and BatchIndexCounter are set it derives a deterministic id from the job ID and an
+// atomically-assigned batch index, so that replaying a batch after resuming from a
+// checkpoint is deduplicated server-side by SQS instead of producing a duplicate message.
+func (uploader *SQSBatchUploader) NextBatchID() string {
+	if uploader.BatchIndexCounter == nil || uploader.JobID == "" {
+		return randomID()
+	}
+	batchIndex := atomic.AddInt64(uploader.BatchIndexCounter, 1)
+	return deterministicBatchID(uploader.JobID, batchIndex)
+}
+
 func (uploader *SQSBatchUploader) AddToBatch(id string, body *string) error {
 	if len(*body) > _messageSizeLimit {
 		return ErrorMessageExceedsMaxSize(len(*body), _messageSizeLimit)
@@ -92,6 +109,13 @@ func (uploader *SQSBatchUploader) Flush() error {
 }
 
 func (uploader *SQSBatchUploader) enqueueToSQS() error {
+	if uploader.CircuitBreaker != nil {
+		if err := uploader.CircuitBreaker.Acquire(uploader.APIName, int64(uploader.totalBytes)); err != nil {
+			return err
+		}
+		defer uploader.CircuitBreaker.Release(uploader.APIName, int64(uploader.totalBytes))
+	}
+
 	output, err := uploader.Client.SQS().SendMessageBatch(&sqs.SendMessageBatchInput{
 		QueueUrl: aws.String(uploader.QueueURL),
 		Entries:  uploader.messageList,
@@ -0,0 +1,83 @@
+/*
+Copyright 2020 Cortex Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+
+	"github.com/cortexlabs/cortex/pkg/lib/errors"
+	"github.com/cortexlabs/cortex/pkg/operator/config"
+	"github.com/cortexlabs/cortex/pkg/types/spec"
+)
+
+const (
+	_checkpointFile = "enqueue_checkpoint.json"
+
+	// _checkpointInterval is the default number of batches between checkpoint writes; it is
+	// checked alongside the "enqueued N batches" progress log, which is written every 10 batches.
+	_checkpointInterval = 100
+
+	_sourceTypeItemList       = "item_list"
+	_sourceTypeFilePathLister = "file_path_lister"
+	_sourceTypeDelimitedFiles = "delimited_files"
+)
+
+// enqueueCheckpoint is the resumable submission checkpoint written to
+// s3://<bucket>/<jobKey.PrefixKey()>/enqueue_checkpoint.json so that enqueueResume can pick
+// a job back up without re-enqueuing everything already written to SQS.
+type enqueueCheckpoint struct {
+	SourceType    string `json:"source_type"`
+	Cursor        int64  `json:"cursor"` // for ItemList: the next item index to enqueue
+	TotalBatches  int64  `json:"total_batches"`
+	LastS3Key     string `json:"last_s3_key,omitempty"` // for FilePathLister/DelimitedFiles: passed as StartAfter on resume
+	LastItemIndex int64  `json:"last_item_index"`       // for ItemList: index of the last item written
+}
+
+func checkpointS3Key(jobKey spec.JobKey) string {
+	return path.Join(jobKey.PrefixKey(), _checkpointFile)
+}
+
+func writeEnqueueCheckpoint(jobKey spec.JobKey, checkpoint *enqueueCheckpoint) error {
+	err := config.AWS.UploadJSONToS3(checkpoint, config.Cluster.Bucket, checkpointS3Key(jobKey))
+	if err != nil {
+		return errors.Wrap(err, "failed to write enqueue checkpoint", jobKey.UserString())
+	}
+	return nil
+}
+
+// ReadEnqueueCheckpoint is exported so the operator's job status endpoint can surface
+// submission resume state (source type, cursor, batches enqueued so far) alongside the
+// rest of a job's status.
+func ReadEnqueueCheckpoint(jobKey spec.JobKey) (*enqueueCheckpoint, error) {
+	var checkpoint enqueueCheckpoint
+	err := config.AWS.ReadJSONFromS3(&checkpoint, config.Cluster.Bucket, checkpointS3Key(jobKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read enqueue checkpoint", jobKey.UserString())
+	}
+	return &checkpoint, nil
+}
+
+// deterministicBatchID derives a stable SQS message/deduplication id from the job ID and a
+// batch index, so that replaying a batch (e.g. after resuming from a checkpoint) is
+// deduplicated server-side by SQS rather than producing a duplicate message.
+func deterministicBatchID(jobID string, batchIndex int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", jobID, batchIndex)))
+	return hex.EncodeToString(sum[:20]) // 40 hex chars, matching the prior random.String(40) length
+}
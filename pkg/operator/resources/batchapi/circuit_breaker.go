@@ -0,0 +1,239 @@
+/*
+Copyright 2020 Cortex Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchapi
+
+import (
+	"sync"
+	"time"
+)
+
+// LimitKind identifies which dimension of a CircuitBreaker limit was exhausted.
+type LimitKind string
+
+const (
+	LimitKindCount LimitKind = "count"
+	LimitKindBytes LimitKind = "bytes"
+)
+
+const (
+	_defaultAcquireTimeout = 30 * time.Second
+	_globalLimitKey        = "*"
+)
+
+// limitState tracks in-flight SendMessageBatch count/bytes for a single API (or the
+// global ceiling) and blocks Acquire() callers until capacity frees up or it times out.
+type limitState struct {
+	mux        sync.Mutex
+	cond       *sync.Cond
+	count      int64
+	bytes      int64
+	countLimit int64
+	bytesLimit int64
+}
+
+func newLimitState(countLimit, bytesLimit int64) *limitState {
+	s := &limitState{countLimit: countLimit, bytesLimit: bytesLimit}
+	s.cond = sync.NewCond(&s.mux)
+	return s
+}
+
+// acquire blocks until there is room for one more in-flight call of numBytes, or returns
+// the LimitKind that timed out.
+func (s *limitState) acquire(numBytes int64, timeout time.Duration) (bool, LimitKind) {
+	deadline := time.Now().Add(timeout)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for s.count+1 > s.countLimit || s.bytes+numBytes > s.bytesLimit {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if s.count+1 > s.countLimit {
+				return false, LimitKindCount
+			}
+			return false, LimitKindBytes
+		}
+
+		timer := time.AfterFunc(remaining, s.cond.Broadcast)
+		s.cond.Wait()
+		timer.Stop()
+	}
+
+	s.count++
+	s.bytes += numBytes
+	return true, ""
+}
+
+func (s *limitState) release(numBytes int64) {
+	s.mux.Lock()
+	s.count--
+	s.bytes -= numBytes
+	s.cond.Broadcast()
+	s.mux.Unlock()
+}
+
+// setLimits hot-updates this state's limits, waking any acquire callers blocked on the old ones.
+func (s *limitState) setLimits(countLimit, bytesLimit int64) {
+	s.mux.Lock()
+	s.countLimit = countLimit
+	s.bytesLimit = bytesLimit
+	s.cond.Broadcast()
+	s.mux.Unlock()
+}
+
+func (s *limitState) utilization() CircuitBreakerUtilization {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return CircuitBreakerUtilization{
+		Count:      s.count,
+		CountLimit: s.countLimit,
+		Bytes:      s.bytes,
+		BytesLimit: s.bytesLimit,
+	}
+}
+
+// CircuitBreakerUtilization is a point-in-time snapshot of a limitState.
+type CircuitBreakerUtilization struct {
+	Count      int64
+	CountLimit int64
+	Bytes      int64
+	BytesLimit int64
+}
+
+// Breaker is the process-wide CircuitBreaker shared by every SQSBatchUploader created by
+// this package, keyed by API name. It is nil until InitCircuitBreaker is called during
+// operator startup (from the limits in config.Cluster), so uploaders created before then
+// run unbounded.
+var Breaker *CircuitBreaker
+
+// InitCircuitBreaker (re)configures the process-wide Breaker. Safe to call again later,
+// e.g. when config.Cluster is hot-reloaded.
+func InitCircuitBreaker(countLimit, bytesLimit, globalCountLimit, globalBytesLimit int64) {
+	if Breaker == nil {
+		Breaker = NewCircuitBreaker(countLimit, bytesLimit, globalCountLimit, globalBytesLimit, 0)
+		return
+	}
+	Breaker.SetLimits(countLimit, bytesLimit, globalCountLimit, globalBytesLimit)
+}
+
+// CircuitBreaker enforces per-API and global ceilings on concurrent in-flight
+// SendMessageBatch calls (LimitKindCount) and bytes outstanding across them (LimitKindBytes).
+type CircuitBreaker struct {
+	mux            sync.Mutex
+	perAPI         map[string]*limitState
+	countLimit     int64
+	bytesLimit     int64
+	globalCount    int64
+	globalBytes    int64
+	acquireTimeout time.Duration
+}
+
+// NewCircuitBreaker builds a CircuitBreaker with the given per-API and global limits. A
+// zero acquireTimeout defaults to _defaultAcquireTimeout.
+func NewCircuitBreaker(countLimit, bytesLimit, globalCountLimit, globalBytesLimit int64, acquireTimeout time.Duration) *CircuitBreaker {
+	if acquireTimeout == 0 {
+		acquireTimeout = _defaultAcquireTimeout
+	}
+
+	cb := &CircuitBreaker{
+		perAPI:         map[string]*limitState{},
+		countLimit:     countLimit,
+		bytesLimit:     bytesLimit,
+		globalCount:    globalCountLimit,
+		globalBytes:    globalBytesLimit,
+		acquireTimeout: acquireTimeout,
+	}
+	cb.perAPI[_globalLimitKey] = newLimitState(globalCountLimit, globalBytesLimit)
+	return cb
+}
+
+// SetLimits hot-updates the default per-API and global limits, including every already-
+// created per-API limitState.
+func (cb *CircuitBreaker) SetLimits(countLimit, bytesLimit, globalCountLimit, globalBytesLimit int64) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.countLimit = countLimit
+	cb.bytesLimit = bytesLimit
+	cb.globalCount = globalCountLimit
+	cb.globalBytes = globalBytesLimit
+
+	for apiName, state := range cb.perAPI {
+		if apiName == _globalLimitKey {
+			state.setLimits(globalCountLimit, globalBytesLimit)
+			continue
+		}
+		state.setLimits(countLimit, bytesLimit)
+	}
+}
+
+func (cb *CircuitBreaker) stateFor(apiName string) *limitState {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	s, ok := cb.perAPI[apiName]
+	if !ok {
+		s = newLimitState(cb.countLimit, cb.bytesLimit)
+		cb.perAPI[apiName] = s
+	}
+	return s
+}
+
+// Acquire blocks until there is room under both the per-API and global limits for one more
+// in-flight call of numBytes, waiting up to acquireTimeout for the per-API limit and then up
+// to acquireTimeout again for the global limit. Callers must call Release with
+// the same apiName and numBytes once the call completes.
+func (cb *CircuitBreaker) Acquire(apiName string, numBytes int64) error {
+	apiState := cb.stateFor(apiName)
+
+	ok, kind := apiState.acquire(numBytes, cb.acquireTimeout)
+	if !ok {
+		return ErrorCircuitBreakerTripped(apiName, kind, limitForKind(apiState, kind))
+	}
+
+	globalState := cb.stateFor(_globalLimitKey)
+	ok, kind = globalState.acquire(numBytes, cb.acquireTimeout)
+	if !ok {
+		apiState.release(numBytes)
+		return ErrorCircuitBreakerTripped(apiName, kind, limitForKind(globalState, kind))
+	}
+
+	return nil
+}
+
+// Release returns the in-flight slot and bytes acquired by a prior, successful Acquire.
+func (cb *CircuitBreaker) Release(apiName string, numBytes int64) {
+	cb.stateFor(apiName).release(numBytes)
+	cb.stateFor(_globalLimitKey).release(numBytes)
+}
+
+// Utilization returns the current in-flight count and bytes for apiName against its
+// limits, for reporting on the operator's status endpoints.
+func (cb *CircuitBreaker) Utilization(apiName string) CircuitBreakerUtilization {
+	return cb.stateFor(apiName).utilization()
+}
+
+// GlobalUtilization returns the current in-flight count and bytes across all APIs.
+func (cb *CircuitBreaker) GlobalUtilization() CircuitBreakerUtilization {
+	return cb.stateFor(_globalLimitKey).utilization()
+}
+
+func limitForKind(s *limitState, kind LimitKind) int64 {
+	if kind == LimitKindBytes {
+		return s.bytesLimit
+	}
+	return s.countLimit
+}
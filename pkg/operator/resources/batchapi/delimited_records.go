@@ -0,0 +1,213 @@
+/*
+Copyright 2020 Cortex Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchapi
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cortexlabs/cortex/pkg/lib/errors"
+	"github.com/cortexlabs/cortex/pkg/operator/schema"
+)
+
+// _quoteCharSentinel stands in for a literal '"' byte while a non-default QuoteChar is
+// swapped in for it (see substituteQuoteChar). It is the NUL byte, which delimited text files
+// are not expected to contain; a NUL already present in a line comes back from
+// restoreQuoteChar as '"'.
+const _quoteCharSentinel = '\x00'
+
+// parseDelimitedChunk parses as many complete records as are available in bytesBuffer,
+// retaining any trailing partial record in state.partial until the next chunk (or, on the
+// file's last chunk, treating it as a final unterminated record). Records are split on
+// quoteChar-aware boundaries (see splitDelimitedRecords) rather than a raw '\n' split, so a
+// quoted field's embedded newline doesn't get mistaken for a record boundary. When
+// csvOpts.Header is set, the first complete record of the file is captured into
+// state.header instead of being enqueued as a record. onBatch is invoked once per completed
+// batch so progress can be reported by the caller (see progressLogger).
+func parseDelimitedChunk(uploader *SQSBatchUploader, format string, csvOpts *schema.CSVOptions, bytesBuffer *bytes.Buffer, jsonMessageList *jsonBuffer, itemIndex *int, state *delimitedParseState, isLastChunk bool, onBatch func()) error {
+	delimiter := ','
+	if format == schema.DelimitedFilesFormatTSV {
+		delimiter = '\t'
+	}
+	if csvOpts != nil && csvOpts.Delimiter != 0 {
+		delimiter = csvOpts.Delimiter
+	}
+
+	quoteChar := rune('"')
+	if csvOpts != nil && csvOpts.QuoteChar != 0 {
+		quoteChar = csvOpts.QuoteChar
+	}
+
+	data := bytesBuffer.Bytes()
+	bytesBuffer.Reset()
+
+	// only the new chunk is scanned, starting from the quote state the previous chunk ended
+	// in; the previous chunk's partial record is then joined onto the record it begins
+	complete, remainder, inQuotes := splitDelimitedRecords(data, quoteChar, state.inQuotes)
+	state.inQuotes = inQuotes
+	if len(state.partial) > 0 {
+		if len(complete) > 0 {
+			complete[0] = append(state.partial, complete[0]...)
+		} else {
+			remainder = append(state.partial, remainder...)
+		}
+		state.partial = nil
+	}
+
+	if isLastChunk && len(remainder) > 0 {
+		complete = append(complete, remainder)
+	} else {
+		state.partial = append([]byte{}, remainder...)
+	}
+
+	for _, rawLine := range complete {
+		line := bytes.TrimSuffix(rawLine, []byte("\r"))
+		if len(line) == 0 {
+			continue
+		}
+
+		fields, err := splitDelimitedLine(line, delimiter, quoteChar)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("item %d", *itemIndex))
+		}
+
+		if csvOpts != nil && csvOpts.Header && state.header == nil {
+			state.header = fields
+			continue
+		}
+
+		doc, err := delimitedRecordToJSON(fields, state.header, csvOpts)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("item %d", *itemIndex))
+		}
+
+		if len(doc) > _messageSizeLimit {
+			return errors.Wrap(ErrorMessageExceedsMaxSize(len(doc), _messageSizeLimit), fmt.Sprintf("item %d", *itemIndex))
+		}
+
+		*itemIndex++
+		jsonMessageList.Add(doc)
+		if jsonMessageList.Length() == jsonMessageList.BatchSize {
+			err := addJSONObjectsToQueue(uploader, jsonMessageList)
+			if err != nil {
+				return err
+			}
+			jsonMessageList.Clear()
+			onBatch()
+		}
+	}
+
+	return nil
+}
+
+// splitDelimitedRecords splits data into complete records terminated by '\n', treating a
+// '\n' inside a quoteChar-quoted field as literal data rather than a record boundary (RFC4180
+// allows quoted fields to span multiple lines). inQuotes carries over whether data starts
+// already inside a field left open by the previous chunk; the returned inQuotes is the state
+// to carry into the next chunk. A doubled quoteChar (the RFC4180 escape for a literal
+// quoteChar inside a quoted field) toggles inQuotes twice in a row, which net cancels out, so
+// this stays correct without special-casing the escape.
+func splitDelimitedRecords(data []byte, quoteChar rune, inQuotes bool) (complete [][]byte, remainder []byte, endInQuotes bool) {
+	quoteByte := byte(quoteChar)
+	recordStart := 0
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case quoteByte:
+			inQuotes = !inQuotes
+		case '\n':
+			if !inQuotes {
+				complete = append(complete, data[recordStart:i])
+				recordStart = i + 1
+			}
+		}
+	}
+	return complete, data[recordStart:], inQuotes
+}
+
+// splitDelimitedLine parses a single CSV/TSV line, respecting quoted fields. encoding/csv
+// hardcodes '"' as its quote character, so a non-default quoteChar is swapped in for it
+// (substituteQuoteChar) before parsing and any literal '"' bytes restored afterward
+// (restoreQuoteChar).
+func splitDelimitedLine(line []byte, delimiter rune, quoteChar rune) ([]string, error) {
+	if quoteChar != '"' {
+		line = substituteQuoteChar(line, quoteChar)
+	}
+
+	r := csv.NewReader(bytes.NewReader(line))
+	r.Comma = delimiter
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+
+	fields, err := r.Read()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if quoteChar != '"' {
+		restoreQuoteChar(fields)
+	}
+	return fields, nil
+}
+
+// substituteQuoteChar rewrites line so quoteChar plays the role of the double quote
+// encoding/csv hardcodes, first moving any literal '"' byte out of the way so it survives
+// the swap; restoreQuoteChar reverses this on the parsed fields.
+func substituteQuoteChar(line []byte, quoteChar rune) []byte {
+	line = bytes.ReplaceAll(line, []byte{'"'}, []byte{_quoteCharSentinel})
+	return bytes.ReplaceAll(line, []byte(string(quoteChar)), []byte{'"'})
+}
+
+func restoreQuoteChar(fields []string) {
+	for i, field := range fields {
+		fields[i] = strings.ReplaceAll(field, string(_quoteCharSentinel), "\"")
+	}
+}
+
+func delimitedRecordToJSON(fields []string, header []string, csvOpts *schema.CSVOptions) (json.RawMessage, error) {
+	nullValue := ""
+	if csvOpts != nil {
+		nullValue = csvOpts.NullValue
+	}
+
+	if header == nil {
+		values := make([]interface{}, len(fields))
+		for i, field := range fields {
+			values[i] = delimitedFieldValue(field, nullValue)
+		}
+		return json.Marshal(values)
+	}
+
+	record := make(map[string]interface{}, len(header))
+	for i, key := range header {
+		if i >= len(fields) {
+			record[key] = nil
+			continue
+		}
+		record[key] = delimitedFieldValue(fields[i], nullValue)
+	}
+	return json.Marshal(record)
+}
+
+func delimitedFieldValue(field string, nullValue string) interface{} {
+	if field == nullValue {
+		return nil
+	}
+	return field
+}
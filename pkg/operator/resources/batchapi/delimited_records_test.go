@@ -0,0 +1,113 @@
+/*
+Copyright 2020 Cortex Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchapi
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cortexlabs/cortex/pkg/operator/schema"
+)
+
+func TestSplitDelimitedLine(t *testing.T) {
+	cases := []struct {
+		name      string
+		line      string
+		delimiter rune
+		quoteChar rune
+		want      []string
+	}{
+		{"simple", "a,b,c", ',', '"', []string{"a", "b", "c"}},
+		{"quoted field with comma", `a,"b,c",d`, ',', '"', []string{"a", "b,c", "d"}},
+		{"tab delimiter", "a\tb\tc", '\t', '"', []string{"a", "b", "c"}},
+		{"non-default quote char", "a,'b,c',d", ',', '\'', []string{"a", "b,c", "d"}},
+		{"literal double quote survives sentinel swap", `a,'say "hi"',b`, ',', '\'', []string{"a", `say "hi"`, "b"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := splitDelimitedLine([]byte(c.line), c.delimiter, c.quoteChar)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSplitDelimitedRecords(t *testing.T) {
+	data := []byte("a,b\n\"c\nd\",e\nf,g")
+
+	complete, remainder, endInQuotes := splitDelimitedRecords(data, '"', false)
+	if endInQuotes {
+		t.Fatalf("expected endInQuotes=false")
+	}
+	want := [][]byte{[]byte("a,b"), []byte("\"c\nd\",e")}
+	if !reflect.DeepEqual(complete, want) {
+		t.Errorf("got complete=%q, want %q", complete, want)
+	}
+	if string(remainder) != "f,g" {
+		t.Errorf("got remainder=%q, want %q", remainder, "f,g")
+	}
+}
+
+func TestSplitDelimitedRecordsCarriesOpenQuoteAcrossChunks(t *testing.T) {
+	complete, remainder, endInQuotes := splitDelimitedRecords([]byte("\"open\nfield"), '"', false)
+	if len(complete) != 0 {
+		t.Fatalf("expected no complete records while still inside a quoted field, got %q", complete)
+	}
+	if !endInQuotes {
+		t.Fatalf("expected endInQuotes=true")
+	}
+	if string(remainder) != "\"open\nfield" {
+		t.Errorf("got remainder=%q", remainder)
+	}
+}
+
+func TestDelimitedRecordToJSON(t *testing.T) {
+	t.Run("no header", func(t *testing.T) {
+		doc, err := delimitedRecordToJSON([]string{"1", "2"}, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(doc) != `["1","2"]` {
+			t.Errorf("got %s", doc)
+		}
+	})
+
+	t.Run("with header", func(t *testing.T) {
+		doc, err := delimitedRecordToJSON([]string{"1"}, []string{"a", "b"}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(doc) != `{"a":"1","b":null}` {
+			t.Errorf("got %s", doc)
+		}
+	})
+
+	t.Run("null value", func(t *testing.T) {
+		doc, err := delimitedRecordToJSON([]string{"NA"}, []string{"a"}, &schema.CSVOptions{NullValue: "NA"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(doc) != `{"a":null}` {
+			t.Errorf("got %s", doc)
+		}
+	})
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2020 Cortex Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchapi
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/cortexlabs/cortex/pkg/lib/cron"
+	"github.com/cortexlabs/cortex/pkg/lib/errors"
+	"github.com/cortexlabs/cortex/pkg/operator/config"
+	"github.com/cortexlabs/cortex/pkg/operator/schema"
+	"github.com/cortexlabs/cortex/pkg/types/spec"
+)
+
+// _exportPollInterval is how often DescribeExport is polled while a PITR export is running;
+// exports of any real size take minutes, so this doesn't need to be as tight as the liveness
+// check's 20 seconds.
+const _exportPollInterval = 30 * time.Second
+
+// _exportMaxDescribeFailures bounds how many consecutive DescribeExport errors
+// waitForDynamoDBExport tolerates before giving up on the export.
+const _exportMaxDescribeFailures = 5
+
+var _requiredDynamoDBExportActions = []string{
+	"dynamodb:ExportTableToPointInTime",
+	"dynamodb:DescribeExport",
+	"s3:GetObject",
+}
+
+// enqueueDynamoDBExportFrom isn't resumable yet (unlike enqueueItemsFrom/enqueueS3PathsFrom/
+// enqueueS3FileContentsFrom): enqueueResume doesn't have a case for it.
+func enqueueDynamoDBExportFrom(jobSpec *spec.Job, export *schema.DynamoDBExport) (int, error) {
+	if export.FilterExpression != "" {
+		return 0, ErrorDynamoDBExportFilterNotSupported()
+	}
+
+	if err := validateDynamoDBExportPermissions(export); err != nil {
+		return 0, err
+	}
+
+	exportArn, err := startDynamoDBExport(jobSpec, export)
+	if err != nil {
+		return 0, err
+	}
+
+	manifestS3Key, err := waitForDynamoDBExport(jobSpec, exportArn)
+	if err != nil {
+		return 0, err
+	}
+
+	return enqueueDynamoExport(jobSpec, export, manifestS3Key)
+}
+
+func startDynamoDBExport(jobSpec *spec.Job, export *schema.DynamoDBExport) (string, error) {
+	output, err := config.AWS.DynamoDB().ExportTableToPointInTime(&dynamodb.ExportTableToPointInTimeInput{
+		TableArn:     aws.String(export.TableARN),
+		S3Bucket:     aws.String(export.S3Bucket),
+		S3Prefix:     aws.String(export.S3Prefix),
+		ExportFormat: aws.String(dynamodb.ExportFormatDynamodbJson),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to start DynamoDB export", jobSpec.UserString())
+	}
+
+	exportArn := aws.StringValue(output.ExportDescription.ExportArn)
+	writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("started DynamoDB PITR export %s for table %s", exportArn, export.TableARN))
+	return exportArn, nil
+}
+
+// waitForDynamoDBExport polls DescribeExport until the export reaches a terminal state,
+// returning the S3 key of the export's manifest-files.json once COMPLETED.
+func waitForDynamoDBExport(jobSpec *spec.Job, exportArn string) (string, error) {
+	done := make(chan struct {
+		manifestS3Key string
+		err           error
+	}, 1)
+
+	describeFailures := 0
+	pollExport := func() error {
+		describeOutput, err := config.AWS.DynamoDB().DescribeExport(&dynamodb.DescribeExportInput{
+			ExportArn: aws.String(exportArn),
+		})
+		if err != nil {
+			describeFailures++
+			if describeFailures >= _exportMaxDescribeFailures {
+				done <- struct {
+					manifestS3Key string
+					err           error
+				}{err: errors.Wrap(err, fmt.Sprintf("failed to describe DynamoDB export %s after %d consecutive attempts", exportArn, describeFailures))}
+				return nil
+			}
+			return errors.Wrap(err, "failed to describe DynamoDB export", exportArn)
+		}
+		describeFailures = 0
+
+		description := describeOutput.ExportDescription
+		writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("DynamoDB export %s status: %s", exportArn, aws.StringValue(description.ExportStatus)))
+
+		switch aws.StringValue(description.ExportStatus) {
+		case dynamodb.ExportStatusCompleted:
+			done <- struct {
+				manifestS3Key string
+				err           error
+			}{manifestS3Key: aws.StringValue(description.ExportManifest)}
+		case dynamodb.ExportStatusFailed:
+			done <- struct {
+				manifestS3Key string
+				err           error
+			}{err: ErrorDynamoDBExportFailed(exportArn, aws.StringValue(description.FailureMessage))}
+		}
+		return nil
+	}
+
+	pollCron := cron.Run(pollExport, cronErrHandler(fmt.Sprintf("DynamoDB export poll for %s", jobSpec.UserString())), _exportPollInterval)
+	defer pollCron.Cancel()
+
+	result := <-done
+	return result.manifestS3Key, result.err
+}
+
+// enqueueDynamoExport walks the export's manifest-files.json, streaming each listed
+// data/*.json.gz file into the existing SQSBatchUploader like the other submission sources.
+func enqueueDynamoExport(jobSpec *spec.Job, export *schema.DynamoDBExport, manifestS3Key string) (int, error) {
+	dataFileKeys, err := readDynamoDBExportManifest(export.S3Bucket, manifestS3Key)
+	if err != nil {
+		return 0, err
+	}
+
+	batchSize := 10
+	if export.BatchSize != nil {
+		batchSize = *export.BatchSize
+	}
+
+	uploader := &SQSBatchUploader{
+		Client:            config.AWS,
+		QueueURL:          jobSpec.SQSUrl,
+		APIName:           jobSpec.APIName,
+		CircuitBreaker:    Breaker,
+		Retries:           aws.Int(3),
+		JobID:             jobSpec.JobKey.ID,
+		BatchIndexCounter: new(int64),
+	}
+	jsonMessageList := newJSONBuffer(batchSize)
+
+	for _, dataFileKey := range dataFileKeys {
+		writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("enqueuing DynamoDB export data file %s", dataFileKey))
+
+		if err := streamDynamoDBDataFile(export.S3Bucket, dataFileKey, uploader, jsonMessageList); err != nil {
+			return uploader.TotalBatches, errors.Wrap(err, dataFileKey)
+		}
+	}
+
+	if jsonMessageList.Length() != 0 {
+		if err := addJSONObjectsToQueue(uploader, jsonMessageList); err != nil {
+			return uploader.TotalBatches, err
+		}
+		jsonMessageList.Clear()
+	}
+
+	if err := uploader.Flush(); err != nil {
+		return uploader.TotalBatches, err
+	}
+
+	return uploader.TotalBatches, nil
+}
+
+// readDynamoDBExportManifest reads manifest-files.json and returns the export's
+// data/*.json.gz S3 keys in order.
+func readDynamoDBExportManifest(bucket string, manifestS3Key string) ([]string, error) {
+	output, err := config.AWS.S3().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(manifestS3Key),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read DynamoDB export manifest", manifestS3Key)
+	}
+	defer output.Body.Close()
+
+	var dataFileKeys []string
+	scanner := bufio.NewScanner(output.Body)
+	for scanner.Scan() {
+		var entry struct {
+			DataFileS3Key string `json:"dataFileS3Key"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.Wrap(err, "failed to parse DynamoDB export manifest", manifestS3Key)
+		}
+		if entry.DataFileS3Key != "" {
+			dataFileKeys = append(dataFileKeys, entry.DataFileS3Key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read DynamoDB export manifest", manifestS3Key)
+	}
+
+	return dataFileKeys, nil
+}
+
+// streamDynamoDBDataFile decodes a gzip-compressed data/*.json.gz file, one DynamoDB JSON
+// item per line, adding each to jsonMessageList and flushing full batches to uploader.
+func streamDynamoDBDataFile(bucket string, key string, uploader *SQSBatchUploader, jsonMessageList *jsonBuffer) error {
+	output, err := config.AWS.S3().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer output.Body.Close()
+
+	gzReader, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer gzReader.Close()
+
+	scanner := bufio.NewScanner(gzReader)
+	scanner.Buffer(make([]byte, 0, _fileBuffer), _fileBuffer)
+
+	for scanner.Scan() {
+		var record struct {
+			Item map[string]*dynamodb.AttributeValue `json:"Item"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return errors.WithStack(err)
+		}
+
+		var item map[string]interface{}
+		if err := dynamodbattribute.UnmarshalMap(record.Item, &item); err != nil {
+			return errors.WithStack(err)
+		}
+
+		doc, err := json.Marshal(item)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(doc) > _messageSizeLimit {
+			return ErrorMessageExceedsMaxSize(len(doc), _messageSizeLimit)
+		}
+
+		jsonMessageList.Add(doc)
+		if jsonMessageList.Length() == jsonMessageList.BatchSize {
+			if err := addJSONObjectsToQueue(uploader, jsonMessageList); err != nil {
+				return err
+			}
+			jsonMessageList.Clear()
+		}
+	}
+
+	return errors.WithStack(scanner.Err())
+}
+
+// validateDynamoDBExportPermissions simulates the operator's IAM policy against the actions
+// a DynamoDB export needs, so a job submission fails fast instead of mid-export.
+func validateDynamoDBExportPermissions(export *schema.DynamoDBExport) error {
+	callerIdentity, err := config.AWS.STS().GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve caller identity for DynamoDB export permission check")
+	}
+
+	simOutput, err := config.AWS.IAM().SimulatePrincipalPolicy(&iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: callerIdentity.Arn,
+		ActionNames:     aws.StringSlice(_requiredDynamoDBExportActions),
+		ResourceArns: []*string{
+			aws.String(export.TableARN),
+			aws.String(s3ExportResourceARN(export.S3Bucket, export.S3Prefix)),
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to simulate IAM policy for DynamoDB export permission check")
+	}
+
+	var deniedActions []string
+	for _, result := range simOutput.EvaluationResults {
+		if aws.StringValue(result.EvalDecision) != iam.PolicyEvaluationDecisionTypeAllowed {
+			deniedActions = append(deniedActions, aws.StringValue(result.EvalActionName))
+		}
+	}
+	if len(deniedActions) > 0 {
+		return ErrorMissingDynamoDBExportPermissions(export.TableARN, deniedActions)
+	}
+
+	return nil
+}
+
+// s3ExportResourceARN builds the IAM ARN for the export's destination prefix.
+// SimulatePrincipalPolicy requires a real arn:aws:s3::: resource ARN, not the s3:// URI that
+// awslib.S3Path builds for the human-readable log lines elsewhere in this package.
+func s3ExportResourceARN(bucket string, prefix string) string {
+	if prefix == "" {
+		return fmt.Sprintf("arn:aws:s3:::%s/*", bucket)
+	}
+	return fmt.Sprintf("arn:aws:s3:::%s/%s/*", bucket, prefix)
+}
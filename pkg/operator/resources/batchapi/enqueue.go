@@ -18,19 +18,19 @@ package batchapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"path"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	awslib "github.com/cortexlabs/cortex/pkg/lib/aws"
 	"github.com/cortexlabs/cortex/pkg/lib/cron"
 	"github.com/cortexlabs/cortex/pkg/lib/errors"
-	"github.com/cortexlabs/cortex/pkg/lib/k8s"
 	"github.com/cortexlabs/cortex/pkg/lib/pointer"
 	"github.com/cortexlabs/cortex/pkg/lib/random"
 	"github.com/cortexlabs/cortex/pkg/lib/telemetry"
@@ -77,31 +77,94 @@ func enqueue(jobSpec *spec.Job, submission *schema.JobSubmission) (int, error) {
 
 	livenessCron := cron.Run(livenessUpdater, cronErrHandler(fmt.Sprintf("liveness check for %s", jobSpec.UserString())), 20*time.Second)
 	defer livenessCron.Cancel()
+	defer closeJobLogGroup(jobSpec.JobKey)
 
 	totalBatches := 0
 	if submission.ItemList != nil {
-		totalBatches, err = enqueueItems(jobSpec, submission.ItemList)
+		totalBatches, err = enqueueItemsFrom(jobSpec, submission.ItemList, 0)
 		if err != nil {
 			return 0, err
 		}
 	} else if submission.FilePathLister != nil {
-		totalBatches, err = enqueueS3Paths(jobSpec, submission.FilePathLister)
+		totalBatches, err = enqueueS3PathsFrom(jobSpec, submission.FilePathLister, "", 0)
 		if err != nil {
 			return 0, err
 		}
 	} else if submission.DelimitedFiles != nil {
-		totalBatches, err = enqueueS3FileContents(jobSpec, submission.DelimitedFiles)
+		totalBatches, err = enqueueS3FileContentsFrom(jobSpec, submission.DelimitedFiles, "", 0)
 		if err != nil {
 			return 0, err
 		}
+	} else if submission.DynamoDBExport != nil {
+		totalBatches, err = enqueueDynamoDBExportFrom(jobSpec, submission.DynamoDBExport)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := sendJobCompleteMessage(jobSpec); err != nil {
+		return 0, err
+	}
+
+	return totalBatches, nil
+}
+
+// enqueueResume picks a job submission back up from its enqueue_checkpoint.json, advancing
+// the relevant iterator to the checkpointed cursor/last-seen S3 key before resuming uploads,
+// so that a job killed partway through (operator restart, an AWS error surviving retries)
+// doesn't have to be resubmitted from scratch.
+func enqueueResume(jobSpec *spec.Job, submission *schema.JobSubmission) (int, error) {
+	checkpoint, err := ReadEnqueueCheckpoint(jobSpec.JobKey)
+	if err != nil {
+		return 0, err
+	}
+
+	err = updateLiveness(jobSpec.JobKey)
+	if err != nil {
+		return 0, err
+	}
+
+	livenessUpdater := func() error {
+		return updateLiveness(jobSpec.JobKey)
+	}
+
+	livenessCron := cron.Run(livenessUpdater, cronErrHandler(fmt.Sprintf("liveness check for %s", jobSpec.UserString())), 20*time.Second)
+	defer livenessCron.Cancel()
+	defer closeJobLogGroup(jobSpec.JobKey)
+
+	writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("resuming from checkpoint (%d batches already enqueued)", checkpoint.TotalBatches))
+
+	var resumedBatches int
+	switch checkpoint.SourceType {
+	case _sourceTypeItemList:
+		resumedBatches, err = enqueueItemsFrom(jobSpec, submission.ItemList, int(checkpoint.Cursor))
+	case _sourceTypeFilePathLister:
+		resumedBatches, err = enqueueS3PathsFrom(jobSpec, submission.FilePathLister, checkpoint.LastS3Key, checkpoint.TotalBatches)
+	case _sourceTypeDelimitedFiles:
+		resumedBatches, err = enqueueS3FileContentsFrom(jobSpec, submission.DelimitedFiles, checkpoint.LastS3Key, checkpoint.TotalBatches)
+	default:
+		return 0, errors.ErrorUnexpected(fmt.Sprintf("unrecognized checkpoint source type %q", checkpoint.SourceType))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	totalBatches := int(checkpoint.TotalBatches) + resumedBatches
+
+	if err := sendJobCompleteMessage(jobSpec); err != nil {
+		return 0, err
 	}
 
-	randomID := k8s.RandomName()
-	_, err = config.AWS.SQS().SendMessage(&sqs.SendMessageInput{
+	return totalBatches, nil
+}
+
+func sendJobCompleteMessage(jobSpec *spec.Job) error {
+	dedupID := deterministicBatchID(jobSpec.JobKey.ID, -1) // reserved index for the job_complete placeholder, so a resumed job doesn't enqueue it twice
+	_, err := config.AWS.SQS().SendMessage(&sqs.SendMessageInput{
 		QueueUrl:               aws.String(jobSpec.SQSUrl),
 		MessageBody:            aws.String("\"job_complete\""),
-		MessageDeduplicationId: aws.String(randomID), // prevent content based deduping
-		MessageGroupId:         aws.String(randomID), // aws recommends message group id per message to improve chances of exactly-once
+		MessageDeduplicationId: aws.String(dedupID), // prevent content based deduping
+		MessageGroupId:         aws.String(dedupID), // aws recommends message group id per message to improve chances of exactly-once
 		MessageAttributes: map[string]*sqs.MessageAttributeValue{
 			"job_complete": {
 				DataType:    aws.String("String"),
@@ -110,29 +173,32 @@ func enqueue(jobSpec *spec.Job, submission *schema.JobSubmission) (int, error) {
 		},
 	})
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to enqueue job_complete placeholder")
+		return errors.Wrap(err, "failed to enqueue job_complete placeholder")
 	}
-
-	return totalBatches, nil
+	return nil
 }
 
-func enqueueItems(jobSpec *spec.Job, itemList *schema.ItemList) (int, error) {
-	batchCount := len(itemList.Items) / *itemList.BatchSize
-	if len(itemList.Items)%*itemList.BatchSize != 0 {
+func enqueueItemsFrom(jobSpec *spec.Job, itemList *schema.ItemList, startIndex int) (int, error) {
+	batchCount := (len(itemList.Items) - startIndex) / *itemList.BatchSize
+	if (len(itemList.Items)-startIndex)%*itemList.BatchSize != 0 {
 		batchCount++
 	}
 
-	writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("partitioning %d items found in job submission into %d batches of size %d", len(itemList.Items), batchCount, *itemList.BatchSize))
+	writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("partitioning %d items found in job submission into %d batches of size %d", len(itemList.Items)-startIndex, batchCount, *itemList.BatchSize))
 
 	uploader := SQSBatchUploader{
-		Client:   config.AWS,
-		QueueURL: jobSpec.SQSUrl,
-		Retries:  aws.Int(3),
+		Client:            config.AWS,
+		QueueURL:          jobSpec.SQSUrl,
+		APIName:           jobSpec.APIName,
+		CircuitBreaker:    Breaker,
+		Retries:           aws.Int(3),
+		JobID:             jobSpec.JobKey.ID,
+		BatchIndexCounter: aws.Int64(int64(startIndex) / int64(*itemList.BatchSize)),
 	}
 
 	for i := 0; i < batchCount; i++ {
-		min := i * (*itemList.BatchSize)
-		max := (i + 1) * (*itemList.BatchSize)
+		min := startIndex + i*(*itemList.BatchSize)
+		max := startIndex + (i+1)*(*itemList.BatchSize)
 		if max > len(itemList.Items) {
 			max = len(itemList.Items)
 		}
@@ -142,7 +208,7 @@ func enqueueItems(jobSpec *spec.Job, itemList *schema.ItemList) (int, error) {
 			return 0, errors.Wrap(err, fmt.Sprintf("batch %d", i))
 		}
 
-		err = uploader.AddToBatch(randomID(), pointer.String(string(jsonBytes)))
+		err = uploader.AddToBatch(uploader.NextBatchID(), pointer.String(string(jsonBytes)))
 		if err != nil {
 			if *itemList.BatchSize > 1 {
 				return 0, errors.Wrap(err, fmt.Sprintf("item %d", i))
@@ -152,6 +218,20 @@ func enqueueItems(jobSpec *spec.Job, itemList *schema.ItemList) (int, error) {
 		if uploader.TotalBatches%10 == 0 {
 			writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("enqueued %d batches", uploader.TotalBatches))
 		}
+		if uploader.TotalBatches%_checkpointInterval == 0 {
+			// send the batches still buffered in the uploader so the cursor doesn't run past them
+			if err := uploader.Flush(); err != nil {
+				return 0, err
+			}
+			if err := writeEnqueueCheckpoint(jobSpec.JobKey, &enqueueCheckpoint{
+				SourceType:    _sourceTypeItemList,
+				Cursor:        int64(max),
+				TotalBatches:  int64(startIndex / *itemList.BatchSize + uploader.TotalBatches),
+				LastItemIndex: int64(max - 1),
+			}); err != nil {
+				return 0, err
+			}
+		}
 	}
 
 	err := uploader.Flush()
@@ -159,52 +239,101 @@ func enqueueItems(jobSpec *spec.Job, itemList *schema.ItemList) (int, error) {
 		return 0, err
 	}
 
+	if err := writeEnqueueCheckpoint(jobSpec.JobKey, &enqueueCheckpoint{
+		SourceType:    _sourceTypeItemList,
+		Cursor:        int64(len(itemList.Items)),
+		TotalBatches:  int64(startIndex / *itemList.BatchSize + uploader.TotalBatches),
+		LastItemIndex: int64(len(itemList.Items) - 1),
+	}); err != nil {
+		return 0, err
+	}
+
 	return uploader.TotalBatches, nil
 }
 
-func enqueueS3Paths(jobSpec *spec.Job, s3PathsLister *schema.FilePathLister) (int, error) {
-	s3PathList := []string{}
-	uploader := &SQSBatchUploader{
-		Client:   config.AWS,
-		QueueURL: jobSpec.SQSUrl,
-		Retries:  aws.Int(3),
+func enqueueS3PathsFrom(jobSpec *spec.Job, s3PathsLister *schema.FilePathLister, startAfterKey string, startBatchIndex int64) (int, error) {
+	lister := s3PathsLister.S3Lister
+	if startAfterKey != "" {
+		listerFromCheckpoint := *lister
+		listerFromCheckpoint.StartAfter = startAfterKey
+		lister = &listerFromCheckpoint
 	}
 
-	err := s3IteratorFromLister(s3PathsLister.S3Lister, func(bucket string, s3Obj *s3.Object) (bool, error) {
-		s3Path := awslib.S3Path(bucket, *s3Obj.Key)
+	var totalBatches int64
+	batchIndexCounter := aws.Int64(startBatchIndex)
+	keyTracker := newS3CheckpointTracker(startAfterKey)
 
-		s3PathList = append(s3PathList, s3Path)
-		if len(s3PathList) == *s3PathsLister.BatchSize {
-			err := addS3PathsToQueue(uploader, s3PathList)
-			if err != nil {
-				return false, err
+	progress := newProgressLogger(jobSpec.JobKey, func(total int64) {
+		writeEnqueueCheckpoint(jobSpec.JobKey, &enqueueCheckpoint{
+			SourceType:   _sourceTypeFilePathLister,
+			TotalBatches: startBatchIndex + total,
+			LastS3Key:    keyTracker.SafeKey(s3PathsLister.Concurrency),
+		})
+	})
+	defer progress.Close()
+
+	err := runS3WorkerPool(s3PathsLister.Concurrency, lister, func(ctx context.Context, workerIndex int, items <-chan s3WorkItem) error {
+		uploader := &SQSBatchUploader{
+			Client:            config.AWS,
+			QueueURL:          jobSpec.SQSUrl,
+			APIName:           jobSpec.APIName,
+			CircuitBreaker:    Breaker,
+			Retries:           aws.Int(3),
+			JobID:             jobSpec.JobKey.ID,
+			BatchIndexCounter: batchIndexCounter,
+		}
+		s3PathList := []string{}
+		lastKey := startAfterKey
+
+		flush := func() error {
+			if len(s3PathList) == 0 {
+				return nil
+			}
+			if err := addS3PathsToQueue(uploader, s3PathList); err != nil {
+				return err
 			}
 			s3PathList = nil
+			keyTracker.Flushed(workerIndex, lastKey)
+			progress.Report(atomic.AddInt64(&totalBatches, 1))
+			return nil
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case item, ok := <-items:
+				if !ok {
+					if err := flush(); err != nil {
+						return err
+					}
+					return uploader.Flush()
+				}
 
-			if uploader.TotalBatches%10 == 0 {
-				writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("enqueued %d batches", uploader.TotalBatches))
+				s3Path := awslib.S3Path(item.Bucket, *item.Object.Key)
+				s3PathList = append(s3PathList, s3Path)
+				lastKey = *item.Object.Key
+				if len(s3PathList) == *s3PathsLister.BatchSize {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
 			}
 		}
-
-		return true, nil
 	})
 	if err != nil {
-		return 0, err
-	}
-
-	if len(s3PathList) > 0 {
-		err := addS3PathsToQueue(uploader, s3PathList)
-		if err != nil {
-			return 0, err
-		}
+		return int(totalBatches), err
 	}
 
-	err = uploader.Flush()
-	if err != nil {
-		return 0, err
+	if err := writeEnqueueCheckpoint(jobSpec.JobKey, &enqueueCheckpoint{
+		SourceType:   _sourceTypeFilePathLister,
+		TotalBatches: startBatchIndex + totalBatches,
+		LastS3Key:    keyTracker.FinalKey(),
+	}); err != nil {
+		return int(totalBatches), err
 	}
 
-	return uploader.TotalBatches, nil
+	return int(totalBatches), nil
 }
 
 func addS3PathsToQueue(uploader *SQSBatchUploader, s3PathList []string) error {
@@ -213,7 +342,7 @@ func addS3PathsToQueue(uploader *SQSBatchUploader, s3PathList []string) error {
 		return errors.Wrap(err, fmt.Sprintf("batch %d", uploader.TotalBatches))
 	}
 
-	err = uploader.AddToBatch(randomID(), pointer.String(string(jsonBytes)))
+	err = uploader.AddToBatch(uploader.NextBatchID(), pointer.String(string(jsonBytes)))
 	if err != nil {
 		return err
 	}
@@ -244,58 +373,130 @@ func (j *jsonBuffer) Length() int {
 	return len(j.messageList)
 }
 
-func enqueueS3FileContents(jobSpec *spec.Job, delimitedFiles *schema.DelimitedFiles) (int, error) {
-	jsonMessageList := newJSONBuffer(*delimitedFiles.BatchSize)
-	uploader := &SQSBatchUploader{
-		Client:   config.AWS,
-		QueueURL: jobSpec.SQSUrl,
-		Retries:  aws.Int(3),
+func enqueueS3FileContentsFrom(jobSpec *spec.Job, delimitedFiles *schema.DelimitedFiles, startAfterKey string, startBatchIndex int64) (int, error) {
+	format := delimitedFiles.Format
+	if format == "" {
+		format = schema.DelimitedFilesFormatJSON
+	}
+
+	lister := delimitedFiles.S3Lister
+	if startAfterKey != "" {
+		listerFromCheckpoint := *lister
+		listerFromCheckpoint.StartAfter = startAfterKey
+		lister = &listerFromCheckpoint
 	}
 
-	bytesBuffer := bytes.NewBuffer([]byte{})
-	err := s3IteratorFromLister(delimitedFiles.S3Lister, func(bucket string, s3Obj *s3.Object) (bool, error) {
-		s3Path := awslib.S3Path(bucket, *s3Obj.Key)
-		writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("enqueuing contents from file %s", s3Path))
+	var totalBatches int64
+	batchIndexCounter := aws.Int64(startBatchIndex)
+	keyTracker := newS3CheckpointTracker(startAfterKey)
 
-		itemIndex := 0
-		err := config.AWS.S3FileIterator(bucket, s3Obj, _fileBuffer, func(readCloser io.ReadCloser, isLastChunk bool) (bool, error) {
-			_, err := bytesBuffer.ReadFrom(readCloser)
-			if err != nil {
-				return false, err
-			}
-			err = streamJSONToQueue(jobSpec, uploader, bytesBuffer, jsonMessageList, &itemIndex)
-			if err != nil {
-				if err != io.ErrUnexpectedEOF || (err == io.ErrUnexpectedEOF && isLastChunk) {
-					return false, err
-				}
-			}
-			return true, nil
+	progress := newProgressLogger(jobSpec.JobKey, func(total int64) {
+		writeEnqueueCheckpoint(jobSpec.JobKey, &enqueueCheckpoint{
+			SourceType:   _sourceTypeDelimitedFiles,
+			TotalBatches: startBatchIndex + total,
+			LastS3Key:    keyTracker.SafeKey(delimitedFiles.Concurrency),
 		})
-		if err != nil {
-			return false, errors.Wrap(err, s3Path)
+	})
+	defer progress.Close()
+
+	err := runS3WorkerPool(delimitedFiles.Concurrency, lister, func(ctx context.Context, workerIndex int, items <-chan s3WorkItem) error {
+		jsonMessageList := newJSONBuffer(*delimitedFiles.BatchSize)
+		uploader := &SQSBatchUploader{
+			Client:            config.AWS,
+			QueueURL:          jobSpec.SQSUrl,
+			APIName:           jobSpec.APIName,
+			CircuitBreaker:    Breaker,
+			Retries:           aws.Int(3),
+			JobID:             jobSpec.JobKey.ID,
+			BatchIndexCounter: batchIndexCounter,
+		}
+		bytesBuffer := bytes.NewBuffer([]byte{})
+		lastKey := startAfterKey
+		onBatch := func() {
+			keyTracker.Flushed(workerIndex, lastKey)
+			progress.Report(atomic.AddInt64(&totalBatches, 1))
 		}
 
-		return true, nil
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case item, ok := <-items:
+				if !ok {
+					if jsonMessageList.Length() != 0 {
+						if err := addJSONObjectsToQueue(uploader, jsonMessageList); err != nil {
+							return err
+						}
+						jsonMessageList.Clear()
+						onBatch()
+					}
+					return uploader.Flush()
+				}
+
+				s3Path := awslib.S3Path(item.Bucket, *item.Object.Key)
+				progress.Log(fmt.Sprintf("enqueuing contents from file %s", s3Path))
+				lastKey = *item.Object.Key
+
+				itemIndex := 0
+				delimState := &delimitedParseState{}
+				err := config.AWS.S3FileIterator(item.Bucket, item.Object, _fileBuffer, func(readCloser io.ReadCloser, isLastChunk bool) (bool, error) {
+					_, err := bytesBuffer.ReadFrom(readCloser)
+					if err != nil {
+						return false, err
+					}
+					err = streamRecordsToQueue(uploader, format, delimitedFiles.CSVOptions, bytesBuffer, jsonMessageList, &itemIndex, delimState, isLastChunk, onBatch)
+					if err != nil {
+						if err != io.ErrUnexpectedEOF || (err == io.ErrUnexpectedEOF && isLastChunk) {
+							return false, err
+						}
+					}
+					return true, nil
+				})
+				if err != nil {
+					return errors.Wrap(err, s3Path)
+				}
+			}
+		}
 	})
 	if err != nil {
-		return 0, err
+		return int(totalBatches), err
 	}
 
-	if jsonMessageList.Length() != 0 {
-		err := addJSONObjectsToQueue(uploader, jsonMessageList)
-		if err != nil {
-			return 0, err
-		}
-	}
-	err = uploader.Flush()
-	if err != nil {
-		return 0, err
+	if err := writeEnqueueCheckpoint(jobSpec.JobKey, &enqueueCheckpoint{
+		SourceType:   _sourceTypeDelimitedFiles,
+		TotalBatches: startBatchIndex + totalBatches,
+		LastS3Key:    keyTracker.FinalKey(),
+	}); err != nil {
+		return int(totalBatches), err
 	}
 
-	return uploader.TotalBatches, nil
+	return int(totalBatches), nil
+}
+
+// delimitedParseState carries the bits of parser state that must survive across
+// _fileBuffer chunks of a single S3 object: the CSV/TSV header (captured once per file),
+// any trailing partial record left over from the previous chunk, and whether that partial
+// record is still inside an open quoted field (see splitDelimitedRecords).
+type delimitedParseState struct {
+	header   []string
+	partial  []byte
+	inQuotes bool
 }
 
-func streamJSONToQueue(jobSpec *spec.Job, uploader *SQSBatchUploader, bytesBuffer *bytes.Buffer, jsonMessageList *jsonBuffer, itemIndex *int) error {
+// streamRecordsToQueue dispatches to the format-specific streaming parser for a chunk of
+// file contents already appended to bytesBuffer, enqueuing each decoded record into
+// jsonMessageList. json and ndjson are both streams of concatenated JSON values and share
+// the same decoder; csv and tsv are parsed line-by-line via parseDelimitedChunk.
+func streamRecordsToQueue(uploader *SQSBatchUploader, format string, csvOpts *schema.CSVOptions, bytesBuffer *bytes.Buffer, jsonMessageList *jsonBuffer, itemIndex *int, state *delimitedParseState, isLastChunk bool, onBatch func()) error {
+	switch format {
+	case schema.DelimitedFilesFormatCSV, schema.DelimitedFilesFormatTSV:
+		return parseDelimitedChunk(uploader, format, csvOpts, bytesBuffer, jsonMessageList, itemIndex, state, isLastChunk, onBatch)
+	default:
+		return streamJSONToQueue(uploader, bytesBuffer, jsonMessageList, itemIndex, onBatch)
+	}
+}
+
+func streamJSONToQueue(uploader *SQSBatchUploader, bytesBuffer *bytes.Buffer, jsonMessageList *jsonBuffer, itemIndex *int, onBatch func()) error {
 	dec := json.NewDecoder(bytesBuffer)
 	for {
 		var doc json.RawMessage
@@ -322,10 +523,7 @@ func streamJSONToQueue(jobSpec *spec.Job, uploader *SQSBatchUploader, bytesBuffe
 				return err
 			}
 			jsonMessageList.Clear()
-
-			if uploader.TotalBatches%10 == 0 {
-				writeToJobLogGroup(jobSpec.JobKey, fmt.Sprintf("enqueued %d batches", uploader.TotalBatches))
-			}
+			onBatch()
 		}
 	}
 
@@ -338,7 +536,7 @@ func addJSONObjectsToQueue(uploader *SQSBatchUploader, jsonMessageList *jsonBuff
 		return err
 	}
 
-	err = uploader.AddToBatch(randomID(), pointer.String(string(jsonBytes)))
+	err = uploader.AddToBatch(uploader.NextBatchID(), pointer.String(string(jsonBytes)))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,75 @@
+/*
+Copyright 2020 Cortex Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchapi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cortexlabs/cortex/pkg/lib/errors"
+)
+
+const (
+	ErrMessageExceedsMaxSize            = "batchapi.message_exceeds_max_size"
+	ErrFailedToEnqueueMessages          = "batchapi.failed_to_enqueue_messages"
+	ErrCircuitBreakerTripped            = "batchapi.circuit_breaker_tripped"
+	ErrDynamoDBExportFailed             = "batchapi.dynamodb_export_failed"
+	ErrMissingDynamoDBExportPermissions = "batchapi.missing_dynamodb_export_permissions"
+	ErrDynamoDBExportFilterNotSupported = "batchapi.dynamodb_export_filter_not_supported"
+)
+
+func ErrorMessageExceedsMaxSize(messageSize int, maxSize int) error {
+	return errors.WithStack(&errors.Error{
+		Kind:    ErrMessageExceedsMaxSize,
+		Message: fmt.Sprintf("message of size %d bytes exceeds the max size of %d bytes", messageSize, maxSize),
+	})
+}
+
+func ErrorFailedToEnqueueMessages(message string) error {
+	return errors.WithStack(&errors.Error{
+		Kind:    ErrFailedToEnqueueMessages,
+		Message: message,
+	})
+}
+
+func ErrorCircuitBreakerTripped(apiName string, kind LimitKind, limit int64) error {
+	return errors.WithStack(&errors.Error{
+		Kind:    ErrCircuitBreakerTripped,
+		Message: fmt.Sprintf("timed out waiting for the %s circuit breaker on api %s (limit %d); the cluster is currently overwhelmed with in-flight SQS batches, try again later", kind, apiName, limit),
+	})
+}
+
+func ErrorDynamoDBExportFailed(exportArn string, failureMessage string) error {
+	return errors.WithStack(&errors.Error{
+		Kind:    ErrDynamoDBExportFailed,
+		Message: fmt.Sprintf("DynamoDB export %s failed: %s", exportArn, failureMessage),
+	})
+}
+
+func ErrorMissingDynamoDBExportPermissions(tableARN string, missingActions []string) error {
+	return errors.WithStack(&errors.Error{
+		Kind:    ErrMissingDynamoDBExportPermissions,
+		Message: fmt.Sprintf("the operator's IAM role is missing permissions required to export table %s: %s", tableARN, strings.Join(missingActions, ", ")),
+	})
+}
+
+func ErrorDynamoDBExportFilterNotSupported() error {
+	return errors.WithStack(&errors.Error{
+		Kind:    ErrDynamoDBExportFilterNotSupported,
+		Message: "filter_expression is not supported for DynamoDB export submissions",
+	})
+}
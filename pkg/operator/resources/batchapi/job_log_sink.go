@@ -0,0 +1,354 @@
+/*
+Copyright 2020 Cortex Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cortexlabs/cortex/pkg/lib/errors"
+	libtime "github.com/cortexlabs/cortex/pkg/lib/time"
+	"github.com/cortexlabs/cortex/pkg/operator/config"
+	"github.com/cortexlabs/cortex/pkg/types/spec"
+)
+
+const (
+	_jobLogSinkCloudWatch   = "cloudwatch"
+	_jobLogSinkFluentd      = "fluentd"
+	_jobLogSinkS3           = "s3"
+	_jobLogSinkCloudWatchS3 = "cloudwatch+s3"
+
+	// _s3SinkFlushThreshold is the number of buffered lines an S3Sink rolls into a new log
+	// file at; it trades off object count (cost, listing time) against how much of a job's
+	// tail is lost if the operator crashes between flushes.
+	_s3SinkFlushThreshold = 500
+)
+
+// JobLogSink is the destination a job's progress/status lines are written to over its
+// lifetime. Open is called once a job starts (before any Write), Close once it finishes
+// (success or failure) so buffering sinks like S3Sink can flush what's left.
+type JobLogSink interface {
+	Open(jobKey spec.JobKey) error
+	Write(jobKey spec.JobKey, lines ...string) error
+	Close(jobKey spec.JobKey) error
+}
+
+// NewJobLogSink constructs the sink selected by config.Cluster.JobLogSink. An empty or
+// unrecognized value falls back to CloudWatch, the only sink every cluster has shipped with.
+func NewJobLogSink() JobLogSink {
+	switch config.Cluster.JobLogSink {
+	case _jobLogSinkFluentd:
+		return NewFluentdSink(config.Cluster.FluentdURL)
+	case _jobLogSinkS3:
+		return NewS3Sink()
+	case _jobLogSinkCloudWatchS3:
+		return NewMultiSink(NewCloudWatchSink(), NewS3Sink())
+	default:
+		return NewCloudWatchSink()
+	}
+}
+
+// CloudWatchSink writes job log lines to the per-job CloudWatch Logs log group/stream
+// created by Open, caching each job's UploadSequenceToken in memory.
+type CloudWatchSink struct {
+	mux    sync.Mutex
+	tokens map[spec.JobKey]*string
+}
+
+func NewCloudWatchSink() *CloudWatchSink {
+	return &CloudWatchSink{tokens: map[spec.JobKey]*string{}}
+}
+
+func (s *CloudWatchSink) Open(jobKey spec.JobKey) error {
+	tags := map[string]string{
+		"apiName": jobKey.APIName,
+		"jobID":   jobKey.ID,
+	}
+	for key, value := range config.Cluster.Tags {
+		tags[key] = value
+	}
+
+	_, err := config.AWS.CloudWatchLogs().CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{
+		LogGroupName: aws.String(logGroupNameForJob(jobKey)),
+		Tags:         aws.StringMap(tags),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = config.AWS.CloudWatchLogs().CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(logGroupNameForJob(jobKey)),
+		LogStreamName: aws.String(_operatorService),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	s.mux.Lock()
+	s.tokens[jobKey] = nil
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *CloudWatchSink) Write(jobKey spec.JobKey, lines ...string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	curTime := libtime.ToMillis(time.Now())
+	inputLogEvents := make([]*cloudwatchlogs.InputLogEvent, len(lines))
+	for i, line := range lines {
+		jsonBytes, _ := json.Marshal(fluentdLog{Log: line})
+		inputLogEvents[i] = &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(string(jsonBytes)),
+			Timestamp: aws.Int64(curTime),
+		}
+	}
+
+	token, err := s.tokenFor(jobKey)
+	if err != nil {
+		return err
+	}
+
+	output, err := config.AWS.CloudWatchLogs().PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(logGroupNameForJob(jobKey)),
+		LogStreamName: aws.String(_operatorService),
+		LogEvents:     inputLogEvents,
+		SequenceToken: token,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	s.mux.Lock()
+	s.tokens[jobKey] = output.NextSequenceToken
+	s.mux.Unlock()
+	return nil
+}
+
+// tokenFor returns the cached UploadSequenceToken for jobKey, falling back to a
+// DescribeLogStreams call when this process never called Open for the job (e.g. a job
+// resumed after an operator restart).
+func (s *CloudWatchSink) tokenFor(jobKey spec.JobKey) (*string, error) {
+	s.mux.Lock()
+	token, ok := s.tokens[jobKey]
+	s.mux.Unlock()
+	if ok {
+		return token, nil
+	}
+
+	logStreams, err := config.AWS.CloudWatchLogs().DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(logGroupNameForJob(jobKey)),
+		LogStreamNamePrefix: aws.String(_operatorService),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(logStreams.LogStreams) == 0 {
+		return nil, errors.ErrorUnexpected(fmt.Sprintf("unable to find log stream named '%s' in log group %s", _operatorService, logGroupNameForJob(jobKey)))
+	}
+
+	token = logStreams.LogStreams[0].UploadSequenceToken
+	s.mux.Lock()
+	s.tokens[jobKey] = token
+	s.mux.Unlock()
+	return token, nil
+}
+
+func (s *CloudWatchSink) Close(jobKey spec.JobKey) error {
+	s.mux.Lock()
+	delete(s.tokens, jobKey)
+	s.mux.Unlock()
+	return nil
+}
+
+// FluentdSink forwards job log lines to a fluentd HTTP input, one POST per line using the
+// same fluentdLog JSON envelope CloudWatchSink writes.
+type FluentdSink struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewFluentdSink(endpoint string) *FluentdSink {
+	return &FluentdSink{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *FluentdSink) Open(jobKey spec.JobKey) error {
+	return nil
+}
+
+func (s *FluentdSink) Write(jobKey spec.JobKey, lines ...string) error {
+	for _, line := range lines {
+		jsonBytes, err := json.Marshal(fluentdLog{Log: line})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		resp, err := s.client.Post(s.endpoint, "application/json", bytes.NewReader(jsonBytes))
+		if err != nil {
+			return errors.Wrap(err, "failed to forward job log line to fluentd", jobKey.UserString())
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			return errors.ErrorUnexpected(fmt.Sprintf("fluentd endpoint returned status %d for job %s", resp.StatusCode, jobKey.UserString()))
+		}
+	}
+	return nil
+}
+
+func (s *FluentdSink) Close(jobKey spec.JobKey) error {
+	return nil
+}
+
+// s3SinkBuffer is a single job's pending log lines, plus the index of the next rolling file
+// that buffer will be flushed to.
+type s3SinkBuffer struct {
+	lines     []string
+	fileIndex int
+}
+
+// S3Sink buffers a job's log lines in memory and flushes them as rolling newline-delimited
+// files under s3://<bucket>/<jobKey.PrefixKey()>/logs/.
+type S3Sink struct {
+	mux     sync.Mutex
+	buffers map[spec.JobKey]*s3SinkBuffer
+}
+
+func NewS3Sink() *S3Sink {
+	return &S3Sink{buffers: map[spec.JobKey]*s3SinkBuffer{}}
+}
+
+func (s *S3Sink) Open(jobKey spec.JobKey) error {
+	s.mux.Lock()
+	s.buffers[jobKey] = &s3SinkBuffer{}
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *S3Sink) Write(jobKey spec.JobKey, lines ...string) error {
+	s.mux.Lock()
+	buf, ok := s.buffers[jobKey]
+	if !ok {
+		buf = &s3SinkBuffer{}
+		s.buffers[jobKey] = buf
+	}
+	buf.lines = append(buf.lines, lines...)
+	shouldFlush := len(buf.lines) >= _s3SinkFlushThreshold
+	s.mux.Unlock()
+
+	if shouldFlush {
+		return s.flush(jobKey)
+	}
+	return nil
+}
+
+func (s *S3Sink) Close(jobKey spec.JobKey) error {
+	if err := s.flush(jobKey); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	delete(s.buffers, jobKey)
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *S3Sink) flush(jobKey spec.JobKey) error {
+	s.mux.Lock()
+	buf, ok := s.buffers[jobKey]
+	if !ok || len(buf.lines) == 0 {
+		s.mux.Unlock()
+		return nil
+	}
+	lines := buf.lines
+	fileIndex := buf.fileIndex
+	buf.lines = nil
+	buf.fileIndex++
+	s.mux.Unlock()
+
+	var body bytes.Buffer
+	for _, line := range lines {
+		jsonBytes, err := json.Marshal(fluentdLog{Log: line})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		body.Write(jsonBytes)
+		body.WriteByte('\n')
+	}
+
+	s3Key := path.Join(jobKey.PrefixKey(), "logs", fmt.Sprintf("%08d.log", fileIndex))
+	_, err := config.AWS.S3().PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(config.Cluster.Bucket),
+		Key:    aws.String(s3Key),
+		Body:   bytes.NewReader(body.Bytes()),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to flush job logs to S3", jobKey.UserString())
+	}
+	return nil
+}
+
+// MultiSink fans every Open/Write/Close call out to each wrapped sink in order, continuing
+// on even if one errors, and returns the first error seen, if any.
+type MultiSink struct {
+	sinks []JobLogSink
+}
+
+func NewMultiSink(sinks ...JobLogSink) *MultiSink {
+	return &MultiSink{sinks: sinks}
+}
+
+func (s *MultiSink) Open(jobKey spec.JobKey) error {
+	var firstErr error
+	for _, sink := range s.sinks {
+		if err := sink.Open(jobKey); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *MultiSink) Write(jobKey spec.JobKey, lines ...string) error {
+	var firstErr error
+	for _, sink := range s.sinks {
+		if err := sink.Write(jobKey, lines...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *MultiSink) Close(jobKey spec.JobKey) error {
+	var firstErr error
+	for _, sink := range s.sinks {
+		if err := sink.Close(jobKey); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
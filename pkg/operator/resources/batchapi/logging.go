@@ -17,86 +17,45 @@ limitations under the License.
 package batchapi
 
 import (
-	"encoding/json"
 	"fmt"
-	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
-	"github.com/cortexlabs/cortex/pkg/lib/errors"
-	libtime "github.com/cortexlabs/cortex/pkg/lib/time"
 	"github.com/cortexlabs/cortex/pkg/operator/config"
 	"github.com/cortexlabs/cortex/pkg/types/spec"
 )
 
+// JobSink is the process-wide JobLogSink every job's progress/status lines are written
+// through. It is nil until InitJobLogSink is called during operator startup (from
+// config.Cluster.JobLogSink); createLogGroupForJob/writeToJobLogGroup lazily fall back to a
+// CloudWatchSink so a job started before that runs still logs somewhere.
+var JobSink JobLogSink
+
+// InitJobLogSink (re)configures the process-wide JobSink from config.Cluster.JobLogSink. It
+// is safe to call again later, e.g. when config.Cluster is hot-reloaded.
+func InitJobLogSink() {
+	JobSink = NewJobLogSink()
+}
+
 func logGroupNameForJob(jobKey spec.JobKey) string {
 	return fmt.Sprintf("%s/%s.%s", config.Cluster.LogGroup, jobKey.APIName, jobKey.ID)
 }
 
 func createLogGroupForJob(jobKey spec.JobKey) error {
-	tags := map[string]string{
-		"apiName": jobKey.APIName,
-		"jobID":   jobKey.ID,
-	}
-
-	for key, value := range config.Cluster.Tags {
-		tags[key] = value
-	}
-
-	_, err := config.AWS.CloudWatchLogs().CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{
-		LogGroupName: aws.String(logGroupNameForJob(jobKey)),
-		Tags:         aws.StringMap(tags),
-	})
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	_, err = config.AWS.CloudWatchLogs().CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
-		LogGroupName:  aws.String(logGroupNameForJob(jobKey)),
-		LogStreamName: aws.String(_operatorService),
-	})
-	if err != nil {
-		return errors.WithStack(err)
+	if JobSink == nil {
+		JobSink = NewCloudWatchSink()
 	}
-
-	return nil
+	return JobSink.Open(jobKey)
 }
 
 func writeToJobLogGroup(jobKey spec.JobKey, logLine string, logLines ...string) error {
-	logStreams, err := config.AWS.CloudWatchLogs().DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
-		LogGroupName:        aws.String(logGroupNameForJob(jobKey)),
-		LogStreamNamePrefix: aws.String(_operatorService),
-	})
-	if err != nil {
-		return errors.WithStack(err)
-	}
-
-	if len(logStreams.LogStreams) == 0 {
-		return errors.ErrorUnexpected(fmt.Sprintf("unable to find log stream named '%s' in log group %s", _operatorService, logGroupNameForJob(jobKey)))
-	}
-
-	logLines = append([]string{logLine}, logLines...)
-
-	inputLogEvents := make([]*cloudwatchlogs.InputLogEvent, len(logLines))
-	curTime := libtime.ToMillis(time.Now())
-	for i, line := range logLines {
-		jsonBytes, _ := json.Marshal(fluentdLog{Log: line})
-		inputLogEvents[i] = &cloudwatchlogs.InputLogEvent{
-			Message:   aws.String(string(jsonBytes)),
-			Timestamp: aws.Int64(curTime),
-		}
+	if JobSink == nil {
+		JobSink = NewCloudWatchSink()
 	}
+	return JobSink.Write(jobKey, append([]string{logLine}, logLines...)...)
+}
 
-	_, err = config.AWS.CloudWatchLogs().PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
-		LogGroupName:  aws.String(logGroupNameForJob(jobKey)),
-		LogStreamName: aws.String(_operatorService),
-		LogEvents:     inputLogEvents,
-		SequenceToken: logStreams.LogStreams[0].UploadSequenceToken,
-	},
-	)
-	if err != nil {
-		return errors.WithStack(err)
+func closeJobLogGroup(jobKey spec.JobKey) error {
+	if JobSink == nil {
+		JobSink = NewCloudWatchSink()
 	}
-
-	return nil
+	return JobSink.Close(jobKey)
 }
@@ -0,0 +1,205 @@
+/*
+Copyright 2020 Cortex Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchapi
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cortexlabs/cortex/pkg/operator/schema"
+	"github.com/cortexlabs/cortex/pkg/types/spec"
+)
+
+// s3WorkItem is a single object handed from the lister producer to a worker.
+type s3WorkItem struct {
+	Bucket string
+	Object *s3.Object
+}
+
+// runS3WorkerPool walks lister on a single producer goroutine, feeding *s3.Object entries
+// into a bounded channel consumed by concurrency workers, each running work with a stable
+// workerIndex (see s3CheckpointTracker). The first error from the producer or a worker
+// cancels ctx so the rest stop promptly.
+func runS3WorkerPool(concurrency int, lister *schema.S3Lister, work func(ctx context.Context, workerIndex int, items <-chan s3WorkItem) error) error {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	items := make(chan s3WorkItem, concurrency*4)
+
+	var errOnce sync.Once
+	var firstErr error
+	setErr := func(err error) {
+		if err == nil || err == context.Canceled {
+			return
+		}
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		workerIndex := i
+		go func() {
+			defer wg.Done()
+			setErr(work(ctx, workerIndex, items))
+		}()
+	}
+
+	producerErr := s3IteratorFromLister(lister, func(bucket string, obj *s3.Object) (bool, error) {
+		item := s3WorkItem{Bucket: bucket, Object: obj}
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case items <- item:
+			return true, nil
+		}
+	})
+	setErr(producerErr)
+	close(items)
+	wg.Wait()
+
+	return firstErr
+}
+
+// s3CheckpointTracker tracks, per worker, the S3 key of the last object that worker has
+// durably flushed to SQS, so enqueueS3PathsFrom/enqueueS3FileContentsFrom can checkpoint a
+// resume point that's actually safe (unlike the producer's read-ahead position, which can
+// run past objects a slow or crashed worker never finished).
+type s3CheckpointTracker struct {
+	mux           sync.Mutex
+	startAfterKey string
+	flushed       map[int]string
+	maxKey        string
+}
+
+func newS3CheckpointTracker(startAfterKey string) *s3CheckpointTracker {
+	return &s3CheckpointTracker{startAfterKey: startAfterKey, flushed: map[int]string{}}
+}
+
+// Flushed records that workerIndex has flushed up to and including key.
+func (t *s3CheckpointTracker) Flushed(workerIndex int, key string) {
+	t.mux.Lock()
+	t.flushed[workerIndex] = key
+	if key > t.maxKey {
+		t.maxKey = key
+	}
+	t.mux.Unlock()
+}
+
+// SafeKey returns the minimum key flushed across all workerCount workers, a resume point
+// safe to checkpoint while workers are still running (a resume may re-enqueue some
+// already-completed objects, which NextBatchID's deterministic dedup ids make harmless).
+// Falls back to startAfterKey until every worker has flushed at least once. A workerCount
+// of 0 or less means runtime.NumCPU() workers, as in runS3WorkerPool.
+func (t *s3CheckpointTracker) SafeKey(workerCount int) string {
+	if workerCount <= 0 {
+		workerCount = runtime.NumCPU()
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if len(t.flushed) < workerCount {
+		return t.startAfterKey
+	}
+
+	min := ""
+	for _, key := range t.flushed {
+		if min == "" || key < min {
+			min = key
+		}
+	}
+	return min
+}
+
+// FinalKey returns the true last key flushed across every worker. Only safe to use once
+// runS3WorkerPool has returned.
+func (t *s3CheckpointTracker) FinalKey() string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.maxKey
+}
+
+// progressEvent is either a "enqueued N batches" progress report (totalBatches set) or an
+// arbitrary job log line (line set).
+type progressEvent struct {
+	totalBatches int64
+	line         string
+}
+
+// progressLogger serializes progress lines, ad-hoc job log lines, and periodic checkpoint
+// writes behind a single goroutine, so concurrent workers don't race on JobLogSink's
+// per-job state or clobber each other's checkpoint writes.
+type progressLogger struct {
+	jobKey     spec.JobKey
+	ch         chan progressEvent
+	done       chan struct{}
+	checkpoint func(totalBatches int64)
+}
+
+// newProgressLogger starts the logger goroutine. checkpoint may be nil to disable periodic
+// checkpointing (e.g. for submission types that don't support resuming yet).
+func newProgressLogger(jobKey spec.JobKey, checkpoint func(totalBatches int64)) *progressLogger {
+	pl := &progressLogger{
+		jobKey:     jobKey,
+		ch:         make(chan progressEvent, 64),
+		done:       make(chan struct{}),
+		checkpoint: checkpoint,
+	}
+	go pl.run()
+	return pl
+}
+
+func (pl *progressLogger) run() {
+	defer close(pl.done)
+	for event := range pl.ch {
+		if event.line != "" {
+			writeToJobLogGroup(pl.jobKey, event.line)
+			continue
+		}
+
+		if event.totalBatches%10 == 0 {
+			writeToJobLogGroup(pl.jobKey, fmt.Sprintf("enqueued %d batches", event.totalBatches))
+		}
+		if pl.checkpoint != nil && event.totalBatches%_checkpointInterval == 0 {
+			pl.checkpoint(event.totalBatches)
+		}
+	}
+}
+
+// Report records that totalBatches have now been enqueued.
+func (pl *progressLogger) Report(totalBatches int64) {
+	pl.ch <- progressEvent{totalBatches: totalBatches}
+}
+
+// Log queues an arbitrary job log line to be written by the logger goroutine.
+func (pl *progressLogger) Log(line string) {
+	pl.ch <- progressEvent{line: line}
+}
+
+func (pl *progressLogger) Close() {
+	close(pl.ch)
+	<-pl.done
+}
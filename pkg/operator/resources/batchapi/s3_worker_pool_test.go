@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Cortex Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package batchapi
+
+import "testing"
+
+func TestS3CheckpointTrackerSafeKeyFallsBackUntilEveryWorkerFlushes(t *testing.T) {
+	tracker := newS3CheckpointTracker("start")
+
+	if got := tracker.SafeKey(2); got != "start" {
+		t.Fatalf("got %q, want %q before any worker has flushed", got, "start")
+	}
+
+	tracker.Flushed(0, "b")
+	if got := tracker.SafeKey(2); got != "start" {
+		t.Fatalf("got %q, want %q while worker 1 hasn't flushed yet", got, "start")
+	}
+
+	tracker.Flushed(1, "a")
+	if got := tracker.SafeKey(2); got != "a" {
+		t.Fatalf("got %q, want %q (the minimum across both workers)", got, "a")
+	}
+}
+
+func TestS3CheckpointTrackerSafeKeyAdvancesWithSlowestWorker(t *testing.T) {
+	tracker := newS3CheckpointTracker("")
+	tracker.Flushed(0, "a")
+	tracker.Flushed(1, "a")
+
+	tracker.Flushed(0, "c")
+	if got := tracker.SafeKey(2); got != "a" {
+		t.Fatalf("got %q, want %q; worker 1 hasn't advanced past its first flush", got, "a")
+	}
+
+	tracker.Flushed(1, "b")
+	if got := tracker.SafeKey(2); got != "b" {
+		t.Fatalf("got %q, want %q", got, "b")
+	}
+}
+
+func TestS3CheckpointTrackerFinalKeyIsTrueMax(t *testing.T) {
+	tracker := newS3CheckpointTracker("")
+	tracker.Flushed(0, "a")
+	tracker.Flushed(1, "z")
+	tracker.Flushed(0, "m")
+
+	if got := tracker.FinalKey(); got != "z" {
+		t.Fatalf("got %q, want %q", got, "z")
+	}
+}